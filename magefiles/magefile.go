@@ -4,8 +4,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/aserto-dev/mage-loot/common"
@@ -18,37 +24,373 @@ func init() {
 	os.Setenv("GOPRIVATE", "github.com/aserto-dev")
 }
 
+// distDir is where `poetry build` drops sdists and wheels, and where Sign()
+// writes checksums, Sigstore signatures, and the provenance attestation.
+const distDir = "dist"
+
+const sumsFileName = "SHA256SUMS"
+const provenanceFileName = "provenance.intoto.jsonl"
+
+// bufLockPath is the lockfile Generate() in the authorizer package pins
+// codegen to; its digest is recorded in the release provenance so a wheel
+// can be traced back to the exact proto snapshot it was generated from.
+const bufLockPath = "packages/aserto-authorizer-grpc/buf.lock.json"
+
 // install required dependencies.
 func Deps() {
 	deps.GetAllDeps()
 }
 
-func Bump(next string) error {
+// Bump walks the repo for every aserto-python package's pyproject.toml and
+// bumps its own version plus its [tool.poetry.dependencies] pins on sibling
+// aserto packages, all to the same next version, in one pass.
+//
+// only restricts the bump to a comma-separated list of package names (e.g.
+// "aserto,aserto-directory"); leave it empty to bump everything. dryRun
+// prints the changed lines instead of writing them.
+func Bump(next string, only string, dryRun bool) error {
 	nextVersion, err := common.NextVersion(next)
 	if err != nil {
 		return err
 	}
 	fmt.Println("Bumping version to", nextVersion)
 
-	input, err := os.ReadFile("pyproject.toml")
+	pkgs, err := findPyPackages(".")
+	if err != nil {
+		return err
+	}
+
+	siblings := make(map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		siblings[pkg.name] = true
+	}
+
+	wanted := parseOnly(only)
+	for name := range wanted {
+		if !siblings[name] {
+			return fmt.Errorf("bump: --only package %q not found among %v", name, pkgNames(pkgs))
+		}
+	}
+
+	for _, pkg := range pkgs {
+		if wanted != nil && !wanted[pkg.name] {
+			continue
+		}
+
+		output := bumpPyPackage(pkg.contents, nextVersion, siblings)
+		if output == pkg.contents {
+			continue
+		}
+
+		if dryRun {
+			fmt.Print(bumpDiff(pkg.path, pkg.contents, output))
+			continue
+		}
+
+		if err := os.WriteFile(pkg.path, []byte(output), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Changelog stitches conventional-commit messages made since the last tag
+// into each affected package's CHANGELOG.md, grouping commits by the
+// package directory they touched.
+func Changelog() error {
+	lastTag, err := sh.Output("git", "describe", "--tags", "--abbrev=0")
+	if err != nil {
+		return err
+	}
+
+	commits, err := conventionalCommitsSince(lastTag)
+	if err != nil {
+		return err
+	}
+
+	pkgs, err := findPyPackages(".")
 	if err != nil {
 		return err
 	}
 
-	lines := strings.Split(string(input), "\n")
+	entriesByPackage := make(map[string][]string)
+	for _, commit := range commits {
+		paths, err := changedPaths(commit.sha)
+		if err != nil {
+			return err
+		}
+
+		for _, pkg := range pkgs {
+			if touchesPackage(paths, filepath.Dir(pkg.path)) {
+				entriesByPackage[pkg.path] = append(entriesByPackage[pkg.path], commit.subject)
+			}
+		}
+	}
+
+	for pkgPath, entries := range entriesByPackage {
+		changelogPath := filepath.Join(filepath.Dir(pkgPath), "CHANGELOG.md")
+		if err := prependChangelog(changelogPath, entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type pyPackage struct {
+	path     string
+	name     string
+	contents string
+}
+
+// findPyPackages returns every pyproject.toml under root, along with the
+// [tool.poetry] name it declares.
+func findPyPackages(root string) ([]pyPackage, error) {
+	var pkgs []pyPackage
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" || info.Name() == "dist" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "pyproject.toml" {
+			return nil
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		pkgs = append(pkgs, pyPackage{
+			path:     path,
+			name:     pyPackageName(string(raw)),
+			contents: string(raw),
+		})
+
+		return nil
+	})
+
+	return pkgs, err
+}
+
+func pyPackageName(contents string) string {
+	section := ""
+	for _, line := range strings.Split(contents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = trimmed
+			continue
+		}
+		if section == "[tool.poetry]" && strings.HasPrefix(trimmed, "name = \"") {
+			return strings.Trim(strings.TrimPrefix(trimmed, "name = "), "\"")
+		}
+	}
+
+	return ""
+}
+
+func parseOnly(only string) map[string]bool {
+	if only == "" {
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(only, ",") {
+		wanted[strings.TrimSpace(name)] = true
+	}
+
+	return wanted
+}
+
+func pkgNames(pkgs []pyPackage) []string {
+	names := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		names[i] = pkg.name
+	}
+
+	return names
+}
+
+// inlineVersionRe/barePinRe match the version constraint in, respectively,
+// an inline-table dependency pin (`name = {version = "^1.2.3", extras = [...]}`)
+// and a bare one (`name = "^1.2.3"`), so bumping it preserves any other
+// attributes (extras, optional, markers) on the line. barePinRe is anchored
+// to the whole line so it doesn't also match a quoted attribute inside a
+// path/git dependency's inline table (e.g. `name = {path = "../local"}`).
+var inlineVersionRe = regexp.MustCompile(`version\s*=\s*"[^"]*"`)
+var barePinRe = regexp.MustCompile(`^(\s*[\w.-]+\s*=\s*)"[^"]*"(\s*)$`)
+
+// bumpPyPackage rewrites contents' own [tool.poetry] version and, for every
+// [tool.poetry.dependencies] entry naming a sibling aserto package, pins
+// that dependency to the same nextVersion.
+func bumpPyPackage(contents, nextVersion string, siblings map[string]bool) string {
+	lines := strings.Split(contents, "\n")
+
+	section := ""
+	versionBumped := false
 
 	for i, line := range lines {
-		if strings.Contains(line, "version = \"") {
-			lines[i] = "version = \"" + nextVersion + "\""
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = trimmed
+			continue
+		}
+
+		switch section {
+		case "[tool.poetry]":
+			if !versionBumped && strings.HasPrefix(trimmed, "version = \"") {
+				lines[i] = "version = \"" + nextVersion + "\""
+				versionBumped = true
+			}
+		case "[tool.poetry.dependencies]":
+			key := strings.TrimSpace(strings.SplitN(trimmed, "=", 2)[0])
+			if siblings[key] {
+				lines[i] = bumpDependencyVersion(line, nextVersion)
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// bumpDependencyVersion replaces just the version constraint in a
+// dependency line, leaving any other attributes (extras, optional, markers)
+// untouched. Path/git dependencies with no version key are left as-is.
+func bumpDependencyVersion(line, nextVersion string) string {
+	pin := "^" + nextVersion
+
+	if loc := inlineVersionRe.FindStringIndex(line); loc != nil {
+		return line[:loc[0]] + `version = "` + pin + `"` + line[loc[1]:]
+	}
+
+	if m := barePinRe.FindStringSubmatch(line); m != nil {
+		return m[1] + `"` + pin + `"` + m[2]
+	}
+
+	return line
+}
+
+// bumpDiff renders the lines bumpPyPackage changed, in a minimal diff-like
+// form, for Bump's --dry-run mode.
+func bumpDiff(path, before, after string) string {
+	var buf strings.Builder
+
+	beforeLines := strings.Split(before, "\n")
+	afterLines := strings.Split(after, "\n")
+
+	fmt.Fprintf(&buf, "--- %s\n", path)
+	for i, beforeLine := range beforeLines {
+		if i < len(afterLines) && beforeLine != afterLines[i] {
+			fmt.Fprintf(&buf, "-%s\n+%s\n", beforeLine, afterLines[i])
+		}
+	}
+
+	return buf.String()
+}
+
+type conventionalCommit struct {
+	sha     string
+	subject string
+}
+
+// conventionalCommitsSince returns the conventional commits (feat:, fix:,
+// etc.) made after tag, oldest first.
+func conventionalCommitsSince(tag string) ([]conventionalCommit, error) {
+	out, err := sh.Output("git", "log", "--reverse", tag+"..HEAD", "--pretty=format:%H%x1f%s")
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []conventionalCommit
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "\x1f", 2)
+		if len(parts) != 2 || !isConventionalCommit(parts[1]) {
+			continue
+		}
+
+		commits = append(commits, conventionalCommit{sha: parts[0], subject: parts[1]})
+	}
+
+	return commits, nil
+}
+
+func isConventionalCommit(subject string) bool {
+	for _, kind := range []string{"feat", "fix", "perf", "refactor", "docs", "chore", "test"} {
+		if strings.HasPrefix(subject, kind+":") || strings.HasPrefix(subject, kind+"(") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func changedPaths(sha string) ([]string, error) {
+	out, err := sh.Output("git", "show", "--name-only", "--pretty=format:", sha)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			paths = append(paths, line)
 		}
 	}
-	output := strings.Join(lines, "\n")
 
-	return os.WriteFile("pyproject.toml", []byte(output), 0644)
+	return paths, nil
+}
+
+// touchesPackage reports whether any path in paths belongs to pkgDir. The
+// repo root package (".") only claims files living directly in the root,
+// not files under any subpackage's directory.
+func touchesPackage(paths []string, pkgDir string) bool {
+	for _, path := range paths {
+		if pkgDir == "." {
+			if !strings.Contains(path, "/") {
+				return true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(path, pkgDir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func prependChangelog(path string, entries []string) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var buf strings.Builder
+	buf.WriteString("## Unreleased\n\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "- %s\n", entry)
+	}
+	buf.WriteString("\n")
+	buf.Write(existing)
+
+	return os.WriteFile(path, []byte(buf.String()), 0644)
 }
 
 func Build() error {
-	err := os.RemoveAll("dist")
+	err := os.RemoveAll(distDir)
 	if err != nil {
 		return err
 	}
@@ -56,8 +398,41 @@ func Build() error {
 	return sh.RunV("poetry", "build")
 }
 
+// Sign produces a SHA256SUMS file for every artifact in dist/, signs each
+// artifact and the sums file with cosign's keyless Sigstore flow, and emits
+// an in-toto SLSA provenance attestation tying the release to its source
+// commit and the proto snapshot it was generated from.
+func Sign() error {
+	artifacts, err := distArtifacts()
+	if err != nil {
+		return err
+	}
+	if len(artifacts) == 0 {
+		return fmt.Errorf("no artifacts found in %s; run `mage build` first", distDir)
+	}
+
+	sumsPath := filepath.Join(distDir, sumsFileName)
+	digests, err := writeChecksums(artifacts, sumsPath)
+	if err != nil {
+		return err
+	}
+
+	for _, artifact := range append(artifacts, sumsPath) {
+		if err := cosignSignBlob(artifact); err != nil {
+			return err
+		}
+	}
+
+	return writeProvenance(digests, filepath.Join(distDir, provenanceFileName))
+}
+
 func Push() error {
-	return sh.RunV("poetry", "publish")
+	err := sh.RunV("poetry", "publish")
+	if err != nil {
+		return err
+	}
+
+	return uploadReleaseAssets()
 }
 
 func Release() error {
@@ -66,5 +441,212 @@ func Release() error {
 		return err
 	}
 
+	err = Sign()
+	if err != nil {
+		return err
+	}
+
 	return Push()
 }
+
+// releaseIdentityRegexp restricts Verify to signatures produced by this
+// repo's own release workflow running off main — a wildcard here would
+// accept a signature from anyone's fork with their own free OIDC identity.
+const releaseIdentityRegexp = `^https://github\.com/aserto-dev/aserto-python/\.github/workflows/release\.ya?ml@refs/heads/main$`
+
+// Verify re-validates a downloaded release's artifacts against the
+// <artifact>.sig / <artifact>.pem Sigstore signatures published alongside
+// them by Sign().
+func Verify(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, artifact := range matches {
+		if strings.HasSuffix(artifact, ".sig") || strings.HasSuffix(artifact, ".pem") {
+			continue
+		}
+		// Sign() writes the provenance attestation after signing, so it has
+		// no .sig/.pem of its own.
+		if filepath.Base(artifact) == provenanceFileName {
+			continue
+		}
+
+		err := sh.RunV("cosign", "verify-blob",
+			"--certificate", artifact+".pem",
+			"--signature", artifact+".sig",
+			"--certificate-identity-regexp", releaseIdentityRegexp,
+			"--certificate-oidc-issuer", "https://token.actions.githubusercontent.com",
+			artifact,
+		)
+		if err != nil {
+			return fmt.Errorf("verify %s: %w", artifact, err)
+		}
+	}
+
+	return nil
+}
+
+func distArtifacts() ([]string, error) {
+	entries, err := os.ReadDir(distDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		artifacts = append(artifacts, filepath.Join(distDir, entry.Name()))
+	}
+
+	return artifacts, nil
+}
+
+// writeChecksums writes sumsPath in the standard `sha256sum` format and
+// returns each artifact's digest, keyed by path.
+func writeChecksums(artifacts []string, sumsPath string) (map[string]string, error) {
+	digests := make(map[string]string, len(artifacts))
+
+	var lines []string
+	for _, artifact := range artifacts {
+		digest, err := sha256File(artifact)
+		if err != nil {
+			return nil, err
+		}
+
+		digests[artifact] = digest
+		lines = append(lines, fmt.Sprintf("%s  %s", digest, filepath.Base(artifact)))
+	}
+
+	return digests, os.WriteFile(sumsPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cosignSignBlob signs artifact with cosign's keyless flow, taking the OIDC
+// identity from the CI runner. Signature and certificate land alongside the
+// artifact as <artifact>.sig / <artifact>.pem.
+func cosignSignBlob(artifact string) error {
+	return sh.RunV("cosign", "sign-blob",
+		"--yes",
+		"--output-signature", artifact+".sig",
+		"--output-certificate", artifact+".pem",
+		artifact,
+	)
+}
+
+// provenanceStatement is an in-toto SLSA v1.0 attestation recording the
+// builder identity, source commit, buf image digest used for code
+// generation, and the digests of everything Build() produced.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	PredicateType string              `json:"predicateType"`
+	Subject       []provenanceSubject `json:"subject"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType      string `json:"buildType"`
+	SourceCommit   string `json:"sourceCommit"`
+	BufImageDigest string `json:"bufImageDigest,omitempty"`
+}
+
+func writeProvenance(digests map[string]string, provenancePath string) error {
+	commit, err := sh.Output("git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	statement := provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate: provenancePredicate{
+			BuildType:      "https://github.com/aserto-dev/aserto-python/release@v1",
+			SourceCommit:   commit,
+			BufImageDigest: bufImageDigest(),
+		},
+	}
+
+	for artifact, digest := range digests {
+		statement.Subject = append(statement.Subject, provenanceSubject{
+			Name:   filepath.Base(artifact),
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+
+	statement.Predicate.Builder.ID = builderID()
+
+	raw, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(provenancePath, append(raw, '\n'), 0644)
+}
+
+// bufImageDigest reads the buf image digest Generate() last pinned to, so
+// the provenance attestation ties a release back to the proto snapshot its
+// bindings were generated from. Returns "" if the lockfile isn't present.
+func bufImageDigest() string {
+	raw, err := os.ReadFile(bufLockPath)
+	if err != nil {
+		return ""
+	}
+
+	var lock struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return ""
+	}
+
+	return lock.Digest
+}
+
+// builderID identifies the CI runner that produced the release, as a GitHub
+// Actions workflow ref.
+func builderID() string {
+	return fmt.Sprintf("https://github.com/%s/.github/workflows/%s@%s",
+		os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_WORKFLOW"), os.Getenv("GITHUB_REF"))
+}
+
+// uploadReleaseAssets publishes the Sigstore signatures, certificates, and
+// provenance attestation Sign() produced to the GitHub release for the
+// current tag, alongside the wheels poetry already published to PyPI.
+func uploadReleaseAssets() error {
+	tag, err := sh.Output("git", "describe", "--tags", "--abbrev=0")
+	if err != nil {
+		return err
+	}
+
+	assets, err := filepath.Glob(filepath.Join(distDir, "*"))
+	if err != nil {
+		return err
+	}
+
+	return sh.RunV("gh", append([]string{"release", "upload", tag}, assets...)...)
+}
@@ -0,0 +1,103 @@
+//go:build mage
+// +build mage
+
+package main
+
+import "testing"
+
+func TestBumpPyPackageOwnVersion(t *testing.T) {
+	contents := "[tool.poetry]\n" +
+		"name = \"aserto\"\n" +
+		"version = \"0.20.0\"\n"
+
+	got := bumpPyPackage(contents, "0.21.0", map[string]bool{"aserto": true})
+
+	want := "[tool.poetry]\n" +
+		"name = \"aserto\"\n" +
+		"version = \"0.21.0\"\n"
+
+	if got != want {
+		t.Errorf("bumpPyPackage() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestBumpDependencyVersion(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "bare pin",
+			line: `aserto-authorizer = "^0.20.0"`,
+			want: `aserto-authorizer = "^0.21.0"`,
+		},
+		{
+			name: "inline table preserves extras and optional",
+			line: `aserto-directory = {version = "^0.30.0", extras = ["grpc"], optional = true}`,
+			want: `aserto-directory = {version = "^0.21.0", extras = ["grpc"], optional = true}`,
+		},
+		{
+			name: "path dependency with no version key is left alone",
+			line: `aserto-idp-plugin = {path = "../aserto-idp-plugin", develop = true}`,
+			want: `aserto-idp-plugin = {path = "../aserto-idp-plugin", develop = true}`,
+		},
+		{
+			name: "git dependency with no version key is left alone",
+			line: `aserto-ctl = {git = "https://github.com/aserto-dev/aserto-ctl", branch = "main"}`,
+			want: `aserto-ctl = {git = "https://github.com/aserto-dev/aserto-ctl", branch = "main"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := bumpDependencyVersion(c.line, "0.21.0")
+			if got != c.want {
+				t.Errorf("bumpDependencyVersion(%q) = %q, want %q", c.line, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTouchesPackage(t *testing.T) {
+	cases := []struct {
+		name   string
+		paths  []string
+		pkgDir string
+		want   bool
+	}{
+		{
+			name:   "root package matches a file living directly in root",
+			paths:  []string{"pyproject.toml"},
+			pkgDir: ".",
+			want:   true,
+		},
+		{
+			name:   "root package does not match a file under a subpackage",
+			paths:  []string{"packages/aserto-authorizer-grpc/magefile.go"},
+			pkgDir: ".",
+			want:   false,
+		},
+		{
+			name:   "nested package matches its own files",
+			paths:  []string{"packages/aserto-authorizer-grpc/magefile.go"},
+			pkgDir: "packages/aserto-authorizer-grpc",
+			want:   true,
+		},
+		{
+			name:   "nested package does not match a sibling whose name is a prefix collision",
+			paths:  []string{"packages/aserto-authorizer-grpc-extra/foo.py"},
+			pkgDir: "packages/aserto-authorizer-grpc",
+			want:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := touchesPackage(c.paths, c.pkgDir)
+			if got != c.want {
+				t.Errorf("touchesPackage(%v, %q) = %v, want %v", c.paths, c.pkgDir, got, c.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,17 +13,55 @@ import (
 	"github.com/aserto-dev/mage-loot/buf"
 	"github.com/aserto-dev/mage-loot/deps"
 	"github.com/aserto-dev/mage-loot/fsutil"
+	"github.com/magefile/mage/sh"
+	"gopkg.in/yaml.v2"
 )
 
 var bufImage = "buf.build/aserto-dev/aserto"
 
+// genConfigPath declares the services Generate() produces Python bindings
+// for. See buf/aserto.gen.yaml.
+const genConfigPath = "buf/aserto.gen.yaml"
+
+// manifestPath records the services Generate() last produced, so Clean()
+// can tear down just those outputs instead of the whole aserto/ tree.
+const manifestPath = "aserto/.manifest.json"
+
+// bufLockPath pins the bufImage commit/digest Generate() generates from.
+// Run `mage updateproto` to bump it to the module's current HEAD.
+const bufLockPath = "buf.lock.json"
+
+// bufLock is the resolved BSR module commit used for the last successful
+// Generate(), so regenerating doesn't silently pick up whatever is at HEAD.
+type bufLock struct {
+	Module string `json:"module"`
+	Commit string `json:"commit"`
+	Digest string `json:"digest"`
+}
+
+// service is one entry of buf/aserto.gen.yaml: a selector that resolves to
+// a proto path prefix, generated with its own buf.gen.yaml template so it
+// can pick its own grpc/mypy/stubs plugins. Out is that template's output
+// directory, so Clean() knows exactly what to remove without having to
+// infer it back out of Path.
+type service struct {
+	Name     string `yaml:"name"`
+	Path     string `yaml:"path"`
+	Template string `yaml:"template"`
+	Out      string `yaml:"out"`
+}
+
+type genConfig struct {
+	Services []service `yaml:"services"`
+}
+
 func All() error {
 	Deps()
 	err := Clean()
 	if err != nil {
 		return err
 	}
-	err = Generate()
+	err = Generate("")
 	if err != nil {
 		return err
 	}
@@ -35,14 +74,64 @@ func Deps() {
 	deps.GetAllDeps()
 }
 
-// Generate the Authorizer code
-func Generate() error {
+// Generate the Python bindings for every service listed in buf/aserto.gen.yaml,
+// pinned to the commit recorded in buf.lock.json. Run `mage updateproto` to
+// bump the pin to the module's current HEAD.
+//
+// services is a comma-separated list of service names (e.g.
+// "authorizer,tenant") to generate a subset instead of all of them, e.g.
+// `mage generate authorizer,tenant`. Leave it empty to generate everything.
+func Generate(services string) error {
+	lock, err := readBufLock(bufLockPath)
+	if err != nil {
+		return fmt.Errorf("%s missing or unreadable (%w); run `mage updateproto` to create it", bufLockPath, err)
+	}
+
+	if err := verifyCommitDigest(bufImage, lock.Commit, lock.Digest); err != nil {
+		return err
+	}
+
+	return generateFromImage(bufImage+":"+lock.Commit, services)
+}
+
+// UpdateProto resolves bufImage's current HEAD, and if it has moved since
+// buf.lock.json was last written, rewrites the lockfile and regenerates.
+func UpdateProto() error {
+	lock, err := readBufLock(bufLockPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	commit, digest, err := resolveCommit(bufImage, "")
+	if err != nil {
+		return err
+	}
+
+	if commit == lock.Commit && digest == lock.Digest {
+		fmt.Println(bufLockPath, "already pinned to HEAD commit", commit)
+		return nil
+	}
+
+	fmt.Printf("bumping %s: %s -> %s\n", bufImage, lock.Commit, commit)
+
+	if err := writeBufLock(bufLockPath, bufLock{Module: bufImage, Commit: commit, Digest: digest}); err != nil {
+		return err
+	}
 
-	files, err := getClientFiles()
+	return Generate("")
+}
+
+func generateFromImage(pinnedImage, selectors string) error {
+	cfg, err := loadGenConfig(genConfigPath)
 	if err != nil {
 		return err
 	}
 
+	services := filterServices(cfg.Services, selectors)
+	if len(services) == 0 {
+		return fmt.Errorf("no services selected out of %s", genConfigPath)
+	}
+
 	oldPath := os.Getenv("PATH")
 	currnetDirectory, err := os.Getwd()
 	if err != nil {
@@ -56,59 +145,241 @@ func Generate() error {
 		return err
 	}
 
-	return buf.Run(
-		buf.AddArg("generate"),
-		buf.AddArg("--template"),
-		buf.AddArg(filepath.Join("buf", "buf.gen.yaml")),
-		buf.AddArg(bufImage),
-		buf.AddPaths(files),
-	)
+	bufExportDir, err := exportBufImage(pinnedImage)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bufExportDir)
+
+	generated := make([]string, 0, len(services))
+	for _, svc := range services {
+		files, err := clientFiles(bufExportDir, svc.Path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: found %v files\n", svc.Name, len(files))
+		if len(files) == 0 {
+			continue
+		}
+
+		err = buf.Run(
+			buf.AddArg("generate"),
+			buf.AddArg("--template"),
+			buf.AddArg(svc.Template),
+			buf.AddArg(pinnedImage),
+			buf.AddPaths(files),
+		)
+		if err != nil {
+			return err
+		}
+
+		generated = append(generated, svc.Name)
+	}
+
+	return writeManifest(generated)
 }
 
-func getClientFiles() ([]string, error) {
-	var clientFiles []string
+// resolveCommit looks up the commit and digest bufImage:ref resolves to on
+// the BSR. An empty ref resolves the module's current HEAD.
+func resolveCommit(module, ref string) (commit, digest string, err error) {
+	target := module
+	if ref != "" {
+		target = module + ":" + ref
+	}
+
+	out, err := sh.Output("buf", "beta", "registry", "commit", "get", target, "--format", "json")
+	if err != nil {
+		return "", "", err
+	}
 
+	var resolved struct {
+		Commit string `json:"commit"`
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal([]byte(out), &resolved); err != nil {
+		return "", "", err
+	}
+
+	return resolved.Commit, resolved.Digest, nil
+}
+
+// verifyCommitDigest fails if the digest recorded for commit in buf.lock.json
+// no longer matches what the BSR reports for it.
+func verifyCommitDigest(module, commit, expectedDigest string) error {
+	_, digest, err := resolveCommit(module, commit)
+	if err != nil {
+		return err
+	}
+
+	if digest != expectedDigest {
+		return fmt.Errorf("%s@%s digest mismatch: %s pinned %s, registry reports %s",
+			module, commit, bufLockPath, expectedDigest, digest)
+	}
+
+	return nil
+}
+
+func readBufLock(path string) (bufLock, error) {
+	var lock bufLock
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lock, err
+	}
+
+	err = json.Unmarshal(raw, &lock)
+	return lock, err
+}
+
+func writeBufLock(path string, lock bufLock) error {
+	raw, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, raw, 0644)
+}
+
+func loadGenConfig(path string) (genConfig, error) {
+	var cfg genConfig
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// filterServices narrows services down to the comma-separated names in
+// selectors. An empty selectors string keeps all services.
+func filterServices(services []service, selectors string) []service {
+	if selectors == "" {
+		return services
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(selectors, ",") {
+		wanted[strings.TrimSpace(name)] = true
+	}
+
+	var filtered []service
+	for _, svc := range services {
+		if wanted[svc.Name] {
+			filtered = append(filtered, svc)
+		}
+	}
+
+	return filtered
+}
+
+func exportBufImage(pinnedImage string) (string, error) {
 	bufExportDir, err := ioutil.TempDir("", "bufimage")
 	if err != nil {
-		return clientFiles, err
+		return "", err
 	}
 	bufExportDir = filepath.Join(bufExportDir, "")
 
-	defer os.RemoveAll(bufExportDir)
 	err = buf.Run(
 		buf.AddArg("export"),
-		buf.AddArg(bufImage),
+		buf.AddArg(pinnedImage),
 		buf.AddArg("-o"),
 		buf.AddArg(bufExportDir),
 	)
+	if err != nil {
+		return "", err
+	}
+
+	return bufExportDir, nil
+}
+
+// clientFiles returns the proto files under the exported buf image whose
+// path starts with pathPrefix.
+func clientFiles(bufExportDir, pathPrefix string) ([]string, error) {
+	var clientFiles []string
+
+	filePattern := filepath.Join(bufExportDir, pathPrefix, "**", "*.proto")
+
+	files, err := fsutil.Glob(filePattern, "")
 	if err != nil {
 		return clientFiles, err
 	}
 
-	// Include authorizer files and their transitive dependencies
-	filePatterns := []string{
-		filepath.Join(bufExportDir, "aserto", "authorizer", "authorizer", "**", "*.proto"),
+	for _, f := range files {
+		clientFiles = append(clientFiles, strings.TrimPrefix(f, bufExportDir+string(filepath.Separator)))
 	}
 
-	for _, filePattern := range filePatterns {
-		files, err := fsutil.Glob(filePattern, "")
-		if err != nil {
-			return clientFiles, err
-		}
+	return clientFiles, nil
+}
 
-		for _, f := range files {
-			clientFiles = append(clientFiles, strings.TrimPrefix(f, bufExportDir+string(filepath.Separator)))
-		}
+func writeManifest(services []string) error {
+	if err := os.MkdirAll("aserto", 0755); err != nil {
+		return err
 	}
 
-	fmt.Printf("found: %v files \n", len(clientFiles))
+	raw, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	return clientFiles, nil
+	return ioutil.WriteFile(manifestPath, raw, 0644)
 }
 
-// Removes generated files
+func readManifest() ([]string, error) {
+	raw, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	if err := json.Unmarshal(raw, &services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// Clean removes only the output directories Generate() recorded in its
+// manifest, instead of the whole aserto/ tree.
 func Clean() error {
-	return os.RemoveAll("aserto")
+	cfg, err := loadGenConfig(genConfigPath)
+	if err != nil {
+		return err
+	}
+
+	generated, err := readManifest()
+	if err != nil {
+		return err
+	}
+	if generated == nil {
+		return nil
+	}
+
+	outByName := make(map[string]string, len(cfg.Services))
+	for _, svc := range cfg.Services {
+		outByName[svc.Name] = svc.Out
+	}
+
+	for _, name := range generated {
+		out, ok := outByName[name]
+		if !ok {
+			continue
+		}
+
+		if err := os.RemoveAll(out); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(manifestPath)
 }
 
 // Probably not needed